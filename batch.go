@@ -0,0 +1,145 @@
+package gcm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	cloudmonitoring "google.golang.org/api/monitoring/v3"
+)
+
+//maxSeriesPerBatch is the maximum number of TimeSeries gcm accepts in a
+//single CreateTimeSeriesRequest.
+const maxSeriesPerBatch = 200
+
+//defaultConcurrency is used when Config.Concurrency is left at zero.
+const defaultConcurrency = 4
+
+//maxBatchRetries bounds the exponential backoff applied to a retryable
+//batch publish.
+const maxBatchRetries = 5
+
+//PublishError is returned by Config.Report when at least one batch of
+//TimeSeries failed to publish. It lists every failing batch instead of
+//just the last error seen.
+type PublishError struct {
+	Failed int //number of batches that failed
+	Total  int //number of batches attempted
+	Errs   []error
+}
+
+func (e *PublishError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("gcm: %d/%d batches failed: %s", e.Failed, e.Total, strings.Join(msgs, "; "))
+}
+
+//AllFailed reports whether every batch failed, as opposed to a partial
+//failure of some of them.
+func (e *PublishError) AllFailed() bool {
+	return e.Failed == e.Total
+}
+
+//chunkTimeSeries splits reqs into batches of at most maxSeriesPerBatch
+//series each, gcm's per-request limit.
+func chunkTimeSeries(reqs []*cloudmonitoring.TimeSeries) [][]*cloudmonitoring.TimeSeries {
+	var batches [][]*cloudmonitoring.TimeSeries
+	for len(reqs) > 0 {
+		n := maxSeriesPerBatch
+		if n > len(reqs) {
+			n = len(reqs)
+		}
+		batches = append(batches, reqs[:n])
+		reqs = reqs[n:]
+	}
+	return batches
+}
+
+//retryableError reports whether err is worth retrying: a 429 or 5xx
+//response from gcm, or a context deadline.
+func retryableError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch gerr.Code {
+		case 429, 500, 502, 503, 504:
+			return true
+		}
+	}
+	return false
+}
+
+//backoff returns an exponentially growing, jittered delay to wait
+//before the attempt-th retry (attempt starting at 0).
+func backoff(attempt int) time.Duration {
+	base := 100 * time.Millisecond * time.Duration(uint(1)<<uint(attempt))
+	return base + time.Duration(rand.Int63n(int64(base)+1))
+}
+
+//publishBatch sends one batch to gcm, retrying retryable errors with
+//exponential backoff and jitter.
+func (config *Config) publishBatch(batch []*cloudmonitoring.TimeSeries) error {
+	wr := &cloudmonitoring.CreateTimeSeriesRequest{TimeSeries: batch}
+	var err error
+	for attempt := 0; attempt <= maxBatchRetries; attempt++ {
+		_, err = cloudmonitoring.NewProjectsTimeSeriesService(config.Service).Create(config.Project, wr).Do()
+		if err == nil {
+			return nil
+		}
+		if !retryableError(err) || attempt == maxBatchRetries {
+			break
+		}
+		time.Sleep(backoff(attempt))
+	}
+	types := make([]string, len(batch))
+	for i, ts := range batch {
+		types[i] = ts.Metric.Type
+	}
+	return fmt.Errorf("batch [%s]: %s", strings.Join(types, ", "), err)
+}
+
+//publish sends every batch to gcm, running up to Config.Concurrency of
+//them at a time, and returns a *PublishError listing every batch that
+//failed.
+func (config *Config) publish(batches [][]*cloudmonitoring.TimeSeries) error {
+	concurrency := config.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	sem := make(chan struct{}, concurrency)
+	errs := make([]error, len(batches))
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, batch []*cloudmonitoring.TimeSeries) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := config.publishBatch(batch); err != nil {
+				errs[i] = err
+			}
+		}(i, batch)
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return &PublishError{Failed: len(failed), Total: len(batches), Errs: failed}
+}
@@ -0,0 +1,185 @@
+package gcm
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	cloudmonitoring "google.golang.org/api/monitoring/v3"
+)
+
+// Metric kinds and value types accepted by GCM's MetricDescriptor.MetricKind
+// and MetricDescriptor.ValueType fields.
+// See https://cloud.google.com/monitoring/api/ref_v3/rest/v3/projects.metricDescriptors
+const (
+	MetricKindGauge      = "GAUGE"
+	MetricKindCumulative = "CUMULATIVE"
+	MetricKindDelta      = "DELTA"
+
+	ValueTypeInt64        = "INT64"
+	ValueTypeDouble       = "DOUBLE"
+	ValueTypeDistribution = "DISTRIBUTION"
+)
+
+//LabelSchema describes one label a metric is expected to carry,
+//so that its MetricDescriptor can be created with a proper description
+//and so that Report can refuse points whose labels drifted from it.
+type LabelSchema struct {
+	Key         string
+	Description string
+}
+
+//MetricDescriptorSpec is the metadata a caller registers for a metric
+//name before it is first reported, so that gcm creates a typed
+//MetricDescriptor instead of letting GCM auto-create an untyped one.
+//
+//Name is the go-metrics name, as passed to r.Each, before DotSlashes/
+//customMetric rewriting.
+type MetricDescriptorSpec struct {
+	Name        string
+	DisplayName string
+	Description string
+	Unit        string
+	MetricKind  string
+	ValueType   string
+	Labels      []LabelSchema
+}
+
+//MetricDescriptorRegistry holds the MetricDescriptorSpecs registered by
+//callers and tracks which of them have already been synced to gcm, so
+//that Projects.MetricDescriptors.Create is only called again when a
+//spec changes (descriptor drift).
+//
+//Config.Labels is one static map shared by every metric a Config
+//reports, go-metrics having no notion of per-point labels: every spec
+//registered against the same Config must therefore declare at least
+//the full set of keys in that Config's Labels, or Report will refuse to
+//publish it on every tick.
+type MetricDescriptorRegistry struct {
+	mu     sync.Mutex
+	specs  map[string]MetricDescriptorSpec
+	synced map[string]string //metric name -> signature of the spec last synced
+	warned map[string]bool   //metric name -> whether validateLabels already logged its rejection
+}
+
+//NewMetricDescriptorRegistry returns an empty registry, ready to have
+//specs Registered and to be set on Config.Descriptors.
+func NewMetricDescriptorRegistry() *MetricDescriptorRegistry {
+	return &MetricDescriptorRegistry{
+		specs:  map[string]MetricDescriptorSpec{},
+		synced: map[string]string{},
+		warned: map[string]bool{},
+	}
+}
+
+//Register records metadata for a metric name. Registering a name that
+//was already registered replaces its spec; if the new spec differs from
+//the one last synced, it is resynced on the next Report.
+func (reg *MetricDescriptorRegistry) Register(spec MetricDescriptorSpec) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.specs[spec.Name] = spec
+}
+
+//specFor returns the spec registered for name, if any.
+func (reg *MetricDescriptorRegistry) specFor(name string) (MetricDescriptorSpec, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	spec, ok := reg.specs[name]
+	return spec, ok
+}
+
+//validateLabels refuses labels that carry a key the spec didn't declare.
+//A metric with no registered spec is always accepted, to keep backward
+//compatibility with callers that don't use the registry.
+//
+//The rejection is logged loudly, but only the first time it happens for
+//a given metric name: Config.Labels doesn't change between ticks, so a
+//drifted spec would otherwise log the same error on every Report for as
+//long as the process runs.
+func (reg *MetricDescriptorRegistry) validateLabels(name string, labels map[string]string) error {
+	spec, ok := reg.specFor(name)
+	if !ok {
+		return nil
+	}
+	declared := map[string]bool{}
+	for _, l := range spec.Labels {
+		declared[l.Key] = true
+	}
+	for k := range labels {
+		if declared[k] {
+			continue
+		}
+		err := fmt.Errorf("gcm: label %q of metric %q isn't declared in its MetricDescriptorSpec", k, name)
+		reg.mu.Lock()
+		alreadyWarned := reg.warned[name]
+		reg.warned[name] = true
+		reg.mu.Unlock()
+		if !alreadyWarned {
+			log.Printf("ERROR %s: every metric reported through this Config must declare the Config's full label set in its MetricDescriptorSpec.Labels; %q will be silently dropped from every Report until it does (this is logged once)", err, name)
+		}
+		return err
+	}
+	return nil
+}
+
+//signature is a cheap fingerprint of a spec, used to detect drift
+//between two Registers of the same metric name.
+func signature(spec MetricDescriptorSpec) string {
+	s := fmt.Sprintf("%s|%s|%s|%s|%s", spec.DisplayName, spec.Description, spec.Unit, spec.MetricKind, spec.ValueType)
+	for _, l := range spec.Labels {
+		s += fmt.Sprintf("|%s=%s", l.Key, l.Description)
+	}
+	return s
+}
+
+//descriptor builds the MetricDescriptor to send to gcm for spec.
+func (config *Config) descriptor(spec MetricDescriptorSpec) *cloudmonitoring.MetricDescriptor {
+	typ := customMetric(spec.Name)
+	d := &cloudmonitoring.MetricDescriptor{
+		Name:        config.Project + "/metricDescriptors/" + typ,
+		Type:        typ,
+		DisplayName: spec.DisplayName,
+		Description: spec.Description,
+		Unit:        spec.Unit,
+		MetricKind:  spec.MetricKind,
+		ValueType:   spec.ValueType,
+	}
+	for _, l := range spec.Labels {
+		d.Labels = append(d.Labels, &cloudmonitoring.LabelDescriptor{
+			Key:         l.Key,
+			Description: l.Description,
+		})
+	}
+	return d
+}
+
+//syncDescriptors creates or updates, on gcm, every MetricDescriptor whose
+//spec was registered but never synced, or whose spec changed since the
+//last sync (descriptor drift).
+func (config *Config) syncDescriptors() error {
+	if config.Descriptors == nil {
+		return nil
+	}
+	reg := config.Descriptors
+	reg.mu.Lock()
+	var pending []MetricDescriptorSpec
+	for name, spec := range reg.specs {
+		if reg.synced[name] != signature(spec) {
+			pending = append(pending, spec)
+		}
+	}
+	reg.mu.Unlock()
+
+	svc := cloudmonitoring.NewProjectsMetricDescriptorsService(config.Service)
+	for _, spec := range pending {
+		_, err := svc.Create(config.Project, config.descriptor(spec)).Do()
+		if err != nil {
+			return fmt.Errorf("gcm: creating MetricDescriptor for %q: %s", spec.Name, err)
+		}
+		reg.mu.Lock()
+		reg.synced[spec.Name] = signature(spec)
+		reg.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package gcm
+
+import (
+	"math"
+	"sync"
+
+	cloudmonitoring "google.golang.org/api/monitoring/v3"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+//DefaultBucketOptions is used whenever Config.Buckets is nil: 64
+//exponential buckets growing by a factor of 2, starting at scale 1, so
+//it roughly covers any positive metric without prior knowledge of its
+//range.
+var DefaultBucketOptions = &cloudmonitoring.BucketOptions{
+	ExponentialBuckets: &cloudmonitoring.Exponential{
+		NumFiniteBuckets: 64,
+		GrowthFactor:     2,
+		Scale:            1,
+	},
+}
+
+//bucketBounds returns the bucket boundaries described by opts: the
+//underflow bucket's upper bound, then the upper bound of every finite
+//bucket.
+func bucketBounds(opts *cloudmonitoring.BucketOptions) []float64 {
+	switch {
+	case opts.ExponentialBuckets != nil:
+		e := opts.ExponentialBuckets
+		bounds := make([]float64, e.NumFiniteBuckets+1)
+		for i := range bounds {
+			bounds[i] = e.Scale * math.Pow(e.GrowthFactor, float64(i))
+		}
+		return bounds
+	case opts.LinearBuckets != nil:
+		l := opts.LinearBuckets
+		bounds := make([]float64, l.NumFiniteBuckets+1)
+		for i := range bounds {
+			bounds[i] = l.Offset + l.Width*float64(i)
+		}
+		return bounds
+	case opts.ExplicitBuckets != nil:
+		return opts.ExplicitBuckets.Bounds
+	}
+	return nil
+}
+
+//bucketCounts bins values into the buckets described by bounds (one
+//overflow bucket past the last finite one, per gcm's convention), then
+//scales every count up by count/len(values) since values is only a
+//reservoir sample of the real series.
+//
+//count can be non-zero with no values at all, for a Timer whose backing
+//Histogram wasn't recovered (see (*Config).timerSampleValues): rather
+//than claim a Distribution with no observations in it, the whole count
+//is dumped into the overflow bucket, which is honest about there being
+//real samples while admitting nothing is known about their size.
+func bucketCounts(values []int64, count int64, bounds []float64) []int64 {
+	counts := make([]int64, len(bounds)+1)
+	if len(values) == 0 {
+		if count > 0 {
+			counts[len(bounds)] = count
+		}
+		return counts
+	}
+	for _, v := range values {
+		i := 0
+		for i < len(bounds) && float64(v) >= bounds[i] {
+			i++
+		}
+		counts[i]++
+	}
+	scale := float64(count) / float64(len(values))
+	for i, c := range counts {
+		counts[i] = int64(math.Round(float64(c) * scale))
+	}
+	return counts
+}
+
+//HistogramRegistry tracks the metrics.Histogram backing each Timer built
+//through its NewTimer, scoped to whichever Config it's assigned to
+//(Config.Histograms) so two Configs reporting a Timer under the same
+//name don't clobber each other's Histogram. metrics.Timer has no Sample
+//method of its own, so this is the only way to recover the raw values
+//needed to bin a timer's Distribution.
+type HistogramRegistry struct {
+	mu         sync.Mutex
+	histograms map[string]metrics.Histogram
+}
+
+//NewHistogramRegistry returns an empty registry, ready to have Timers
+//built through it and to be set on Config.Histograms.
+func NewHistogramRegistry() *HistogramRegistry {
+	return &HistogramRegistry{histograms: map[string]metrics.Histogram{}}
+}
+
+//NewTimer builds a metrics.Timer backed by h and an exponentially-decaying
+//meter, and registers h under name so Report can later read its Sample()
+//to bin the timer's Distribution.
+//
+//Use this instead of metrics.NewTimer for any timer gcm should export
+//with real bucket counts; a plain metrics.NewTimer is still reported,
+//but as a Distribution with its whole count in the overflow bucket,
+//since there's no registered Histogram to sample from.
+func (reg *HistogramRegistry) NewTimer(name string, h metrics.Histogram) metrics.Timer {
+	reg.mu.Lock()
+	reg.histograms[name] = h
+	reg.mu.Unlock()
+	return metrics.NewCustomTimer(h, metrics.NewMeter())
+}
+
+//sampleValues returns the sample values of the Histogram registered for
+//name through NewTimer, or nil if there isn't one.
+func (reg *HistogramRegistry) sampleValues(name string) []int64 {
+	reg.mu.Lock()
+	h, ok := reg.histograms[name]
+	reg.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return h.Snapshot().Sample().Values()
+}
+
+//timerSampleValues returns the sample values of the Histogram
+//registered for name in config.Histograms, or nil if there isn't one
+//(including when Config.Histograms itself is nil, the case for any
+//Timer built with plain metrics.NewTimer()).
+func (config *Config) timerSampleValues(name string) []int64 {
+	if config.Histograms == nil {
+		return nil
+	}
+	return config.Histograms.sampleValues(name)
+}
+
+//distribution builds a cloudmonitoring.Distribution out of a go-metrics
+//Histogram/Timer snapshot, approximating the BucketCounts from its
+//(possibly down-sampled) reservoir.
+func (config *Config) distribution(count int64, mean, sumOfSquaredDeviation float64, values []int64) *cloudmonitoring.Distribution {
+	opts := config.Buckets
+	if opts == nil {
+		opts = DefaultBucketOptions
+	}
+	return &cloudmonitoring.Distribution{
+		Count:                 count,
+		Mean:                  mean,
+		SumOfSquaredDeviation: sumOfSquaredDeviation,
+		BucketOptions:         opts,
+		BucketCounts:          bucketCounts(values, count, bucketBounds(opts)),
+	}
+}
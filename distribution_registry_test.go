@@ -0,0 +1,36 @@
+package gcm
+
+import (
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestHistogramRegistryScopesByRegistryNotName(t *testing.T) {
+	regA := NewHistogramRegistry()
+	regB := NewHistogramRegistry()
+
+	timerA := regA.NewTimer("latency", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	timerA.Update(1)
+	timerA.Update(2)
+
+	timerB := regB.NewTimer("latency", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	timerB.Update(100)
+
+	valuesA := regA.sampleValues("latency")
+	valuesB := regB.sampleValues("latency")
+
+	if len(valuesA) != 2 {
+		t.Fatalf("regA sample values = %v, want 2 values", valuesA)
+	}
+	if len(valuesB) != 1 {
+		t.Fatalf("regB sample values = %v, want 1 value", valuesB)
+	}
+}
+
+func TestConfigTimerSampleValuesNilWithoutRegistry(t *testing.T) {
+	config := &Config{}
+	if v := config.timerSampleValues("latency"); v != nil {
+		t.Fatalf("timerSampleValues = %v, want nil", v)
+	}
+}
@@ -0,0 +1,38 @@
+package gcm
+
+import (
+	"reflect"
+	"testing"
+
+	cloudmonitoring "google.golang.org/api/monitoring/v3"
+)
+
+func explicitBucketBounds() []float64 {
+	return bucketBounds(&cloudmonitoring.BucketOptions{
+		ExplicitBuckets: &cloudmonitoring.Explicit{Bounds: []float64{2, 4}},
+	})
+}
+
+func TestBucketCountsBinsValues(t *testing.T) {
+	counts := bucketCounts([]int64{1, 5}, 2, explicitBucketBounds())
+	want := []int64{1, 0, 1}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("bucketCounts = %v, want %v", counts, want)
+	}
+}
+
+func TestBucketCountsFallsBackToOverflowBucketWithoutSamples(t *testing.T) {
+	counts := bucketCounts(nil, 7, explicitBucketBounds())
+	want := []int64{0, 0, 7}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("bucketCounts = %v, want %v (count dumped in the overflow bucket)", counts, want)
+	}
+}
+
+func TestBucketCountsEmptyWhenCountIsZero(t *testing.T) {
+	counts := bucketCounts(nil, 0, explicitBucketBounds())
+	want := []int64{0, 0, 0}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("bucketCounts = %v, want %v", counts, want)
+	}
+}
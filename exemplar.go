@@ -0,0 +1,139 @@
+package gcm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/googleapi"
+	cloudmonitoring "google.golang.org/api/monitoring/v3"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+//ExemplarSampler builds the Exemplar to attach to the Distribution point
+//currently being reported for metric name, whose current value is
+//value, or returns nil to attach none. See Config.ExemplarSampler.
+type ExemplarSampler func(name string, value float64) *cloudmonitoring.Exemplar
+
+//attachExemplar appends the Exemplar built by config.ExemplarSampler, if
+//any, to dist.
+func (config *Config) attachExemplar(dist *cloudmonitoring.Distribution, name string, value float64) {
+	if config.ExemplarSampler == nil {
+		return
+	}
+	if ex := config.ExemplarSampler(name, value); ex != nil {
+		dist.Exemplars = append(dist.Exemplars, ex)
+	}
+}
+
+//TimerContextRegistry tracks the TimerWithContext wrapping each Timer
+//built through its NewTimer, so the ExemplarSampler returned by its
+//WithTraceExemplars (which, like every ExemplarSampler, only gets a name
+//and a value) can recover the context that was active for that metric's
+//last observation. Scoped per-registry, rather than global, so two
+//reporters don't clobber each other's TimerWithContext when they happen
+//to report a Timer under the same name.
+type TimerContextRegistry struct {
+	mu     sync.Mutex
+	timers map[string]*TimerWithContext
+}
+
+//NewTimerContextRegistry returns an empty registry, ready to have Timers
+//built through it.
+func NewTimerContextRegistry() *TimerContextRegistry {
+	return &TimerContextRegistry{timers: map[string]*TimerWithContext{}}
+}
+
+//TimerWithContext wraps a metrics.Timer, remembering the context.Context
+//passed alongside its most recent observation so a span active at
+//observation time can be recovered later, when Report builds that
+//metric's Exemplars.
+type TimerWithContext struct {
+	metrics.Timer
+	name string
+
+	mu      sync.Mutex
+	lastCtx context.Context
+}
+
+//NewTimer wraps t, registering it under name so it can later be found by
+//a sampler returned from reg.WithTraceExemplars.
+func (reg *TimerContextRegistry) NewTimer(name string, t metrics.Timer) *TimerWithContext {
+	wrapped := &TimerWithContext{Timer: t, name: name}
+	reg.mu.Lock()
+	reg.timers[name] = wrapped
+	reg.mu.Unlock()
+	return wrapped
+}
+
+//UpdateSince is metrics.Timer.UpdateSince, but also remembers ctx as the
+//context this observation was made in.
+func (t *TimerWithContext) UpdateSince(ctx context.Context, start time.Time) {
+	t.Timer.UpdateSince(start)
+	t.mu.Lock()
+	t.lastCtx = ctx
+	t.mu.Unlock()
+}
+
+//Time runs f, timing it like metrics.Timer.Time, and remembers ctx as
+//the context this observation was made in.
+func (t *TimerWithContext) Time(ctx context.Context, f func()) {
+	start := time.Now()
+	f()
+	t.UpdateSince(ctx, start)
+}
+
+//lastContext returns the context of the most recent observation, or
+//context.Background() if there hasn't been one yet.
+func (t *TimerWithContext) lastContext() context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lastCtx == nil {
+		return context.Background()
+	}
+	return t.lastCtx
+}
+
+//spanContextAttachment is the Any-style attachment gcm expects to make
+//an Exemplar clickable through to Cloud Trace.
+//See https://cloud.google.com/monitoring/api/ref_v3/rest/v3/TimeSeries#SpanContext
+type spanContextAttachment struct {
+	Type     string `json:"@type"`
+	SpanName string `json:"span_name"`
+}
+
+//WithTraceExemplars returns an ExemplarSampler that, for metrics
+//observed through a TimerWithContext built from reg, attaches the span
+//that was active during the metric's most recent observation as a Cloud
+//Trace attachment, so the Distribution point is clickable through to
+//the trace in the GCM UI.
+func (reg *TimerContextRegistry) WithTraceExemplars(project string) ExemplarSampler {
+	return func(name string, value float64) *cloudmonitoring.Exemplar {
+		reg.mu.Lock()
+		v, ok := reg.timers[name]
+		reg.mu.Unlock()
+		if !ok {
+			return nil
+		}
+		sc := trace.SpanContextFromContext(v.lastContext())
+		if !sc.IsValid() {
+			return nil
+		}
+		attachment, err := json.Marshal(spanContextAttachment{
+			Type:     "type.googleapis.com/google.monitoring.v3.SpanContext",
+			SpanName: fmt.Sprintf("projects/%s/traces/%s/spans/%s", project, sc.TraceID(), sc.SpanID()),
+		})
+		if err != nil {
+			return nil
+		}
+		return &cloudmonitoring.Exemplar{
+			Value:       value,
+			Timestamp:   time.Now().Format(time.RFC3339Nano),
+			Attachments: []googleapi.RawMessage{attachment},
+		}
+	}
+}
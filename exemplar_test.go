@@ -0,0 +1,35 @@
+package gcm
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestTimerContextRegistryScopesByRegistryNotName(t *testing.T) {
+	regA := NewTimerContextRegistry()
+	regB := NewTimerContextRegistry()
+
+	timerA := regA.NewTimer("latency", metrics.NewTimer())
+	ctxA := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    [16]byte{1},
+		SpanID:     [8]byte{1},
+		TraceFlags: trace.FlagsSampled,
+	}))
+	timerA.Time(ctxA, func() {})
+
+	// regB never observes anything for "latency": its sampler must not
+	// see regA's context even though the metric name collides.
+	sampler := regB.WithTraceExemplars("projects/test")
+	if ex := sampler("latency", 1); ex != nil {
+		t.Fatalf("regB sampler = %+v, want nil (no observation recorded in regB)", ex)
+	}
+
+	samplerA := regA.WithTraceExemplars("projects/test")
+	if ex := samplerA("latency", 1); ex == nil {
+		t.Fatal("regA sampler = nil, want an Exemplar from the recorded span context")
+	}
+}
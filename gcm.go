@@ -1,22 +1,15 @@
 //Package gcm Provides a way to send your go-metrics to google cloud monitoring
-//
-// Histograms are not implemented yet because not available in custom metrics,
-// see https://cloud.google.com/monitoring/api/metrics#value-types
-//
-// Timer is to do
 package gcm
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strings"
-	"sync"
 	"time"
 
 	cloudmonitoring "google.golang.org/api/monitoring/v3"
 
-	"encoding/json"
-
 	"github.com/rcrowley/go-metrics"
 )
 
@@ -47,11 +40,65 @@ type Config struct {
 	//setting for MonitoredRessource can change without
 	//you having to recreate the metric.
 	MonitoredRessource *cloudmonitoring.MonitoredResource
+
+	//Descriptors, when set, lets you register per-metric MetricDescriptorSpecs
+	//(unit, description, kind, label schema) so that Report installs/updates
+	//proper typed MetricDescriptors instead of letting GCM auto-create
+	//unlabeled ones. See MetricDescriptorRegistry.
+	Descriptors *MetricDescriptorRegistry
+
+	//Buckets configures how Histogram and Timer samples are binned into
+	//the Distribution points reported for them. A nil Buckets defaults
+	//to DefaultBucketOptions.
+	Buckets *cloudmonitoring.BucketOptions
+
+	//Histograms, when set, lets Report recover the real sample values of
+	//Timers built through its NewTimer, so their Distribution gets
+	//proper bucket counts instead of their whole count landing in the
+	//overflow bucket. See HistogramRegistry.
+	Histograms *HistogramRegistry
+
+	//StartTime is the instant CUMULATIVE points (Counter, Meter total
+	//count) started accumulating from. It is captured once, on the
+	//first Report, and reused on every following tick so they all
+	//describe the same ever-growing interval, as GCM requires.
+	//
+	//Leave it zero to have it captured automatically. Set it explicitly
+	//when a process restarts but keeps adding to the same counters:
+	//GCM rejects a point whose interval duplicates one it already has,
+	//so bump the previous run's StartTime by at least one microsecond
+	//before assigning it here.
+	StartTime time.Time
+
+	//Concurrency is how many batches of TimeSeries Report publishes at
+	//once. gcm caps a single CreateTimeSeriesRequest at 200 series, so
+	//a registry reporting more than that is split into several batches;
+	//a zero Concurrency defaults to defaultConcurrency.
+	Concurrency int
+
+	//ExemplarSampler, when set, is called for every Distribution point
+	//built from a Histogram or Timer and may return an Exemplar to
+	//attach to it, e.g. one pointing at the Cloud Trace span that was
+	//active when the sampled value was observed. See WithTraceExemplars.
+	//A nil return, or a nil ExemplarSampler, attaches nothing.
+	ExemplarSampler ExemplarSampler
+}
+
+//startTimeString formats Config.StartTime for use as a
+//TimeInterval.StartTime. Report captures StartTime, if it isn't already
+//set, before it captures the tick's EndTime, so this never needs to.
+func (config *Config) startTimeString() string {
+	return config.StartTime.Format(time.RFC3339Nano)
+}
+
+//ResetStartTime starts a new CUMULATIVE interval from now, for callers
+//that reset their counters to zero and need gcm to start a fresh
+//cumulative series instead of reporting a value drop.
+func (config *Config) ResetStartTime() {
+	config.StartTime = time.Now()
 }
 
 var (
-	timersNotImplemented     sync.Once
-	histogramsNotImplemented sync.Once
 	//GlobalMonitoredResource is the default monitored
 	//resource that will be sent with the metrics
 	//it doesn't allow much specification
@@ -78,9 +125,13 @@ var (
 //			hostname = "unknown-hostname"
 //		}
 //		go googlecloudmetrics.Monitor(metrics.DefaultRegistry, 15*time.Second, 3, s, gcpProject, map[string]string{"source": hostname, "service": service}, nil)
+//
+//A nil monitoredRessource is auto-detected with DetectMonitoredResource
+//instead of defaulting to GlobalMonitoredResource, so GCE/GKE/Cloud Run
+//deployments get their instance/zone/cluster labels for free.
 func Monitor(r metrics.Registry, tick time.Duration, maxErrors int, service *cloudmonitoring.Service, project string, labels map[string]string, monitoredRessource *cloudmonitoring.MonitoredResource) error {
 	if monitoredRessource == nil {
-		monitoredRessource = GlobalMonitoredResource
+		monitoredRessource = DetectMonitoredResource(context.Background())
 	}
 	reporter := Config{
 		Service:            service,
@@ -93,10 +144,19 @@ func Monitor(r metrics.Registry, tick time.Duration, maxErrors int, service *clo
 	var err error
 	for range ticker.C {
 		err = reporter.Report(r)
-		if err != nil {
-			errors++
-		} else {
+		switch publishErr := err.(type) {
+		case nil:
 			errors = 0
+		case *PublishError:
+			//a partial failure still got some series through: don't let
+			//it count towards maxErrors the way a total outage would.
+			if publishErr.AllFailed() {
+				errors++
+			} else {
+				errors = 0
+			}
+		default:
+			errors++
 		}
 
 		if errors >= maxErrors {
@@ -107,8 +167,26 @@ func Monitor(r metrics.Registry, tick time.Duration, maxErrors int, service *clo
 	return err
 }
 
-//Report every metric from registry to gcm
+//Report every metric from registry to gcm, in batches of at most 200
+//TimeSeries (gcm's limit), published concurrently up to
+//Config.Concurrency at a time. Batches that fail with a retryable error
+//(429/5xx, deadline exceeded) are retried with exponential backoff
+//before being reported as failed.
 func (config *Config) Report(registry metrics.Registry) error {
+	if err := config.syncDescriptors(); err != nil {
+		log.Printf("ERROR syncing gcm MetricDescriptors: %s", err)
+		return err
+	}
+
+	if config.StartTime.IsZero() {
+		//GCM requires a CUMULATIVE point's StartTime to be strictly
+		//before its EndTime, and EndTime is formatted with only
+		//second precision: a StartTime captured here and an EndTime
+		//captured a moment later can still land in the same second,
+		//so back it off by a full second to keep it strictly before.
+		config.StartTime = time.Now().Add(-time.Second)
+	}
+
 	now := time.Now()
 	reqs, err := config.buildTimeSeries(now.Format(time.RFC3339), registry)
 	if err != nil {
@@ -116,13 +194,9 @@ func (config *Config) Report(registry metrics.Registry) error {
 		return err
 	}
 
-	wr := &cloudmonitoring.CreateTimeSeriesRequest{
-		TimeSeries: reqs,
-	}
-	_, err = cloudmonitoring.NewProjectsTimeSeriesService(config.Service).Create(config.Project, wr).Do()
+	err = config.publish(chunkTimeSeries(reqs))
 	if err != nil {
-		b, _ := json.Marshal(wr)
-		log.Printf("ERROR reporting metrics to gcm: %s.Req: %s", err, b)
+		log.Printf("ERROR reporting metrics to gcm: %s", err)
 	}
 	return err
 }
@@ -159,6 +233,11 @@ func (config *Config) newTimeSeries(name string) *cloudmonitoring.TimeSeries {
 //eery metric to send to gcm.
 func (config *Config) buildTimeSeries(start string, r metrics.Registry) (pts []*cloudmonitoring.TimeSeries, err error) {
 	r.Each(func(name string, metric interface{}) {
+		if config.Descriptors != nil {
+			if err := config.Descriptors.validateLabels(name, config.Labels); err != nil {
+				return
+			}
+		}
 		switch m := metric.(type) {
 		case metrics.Counter:
 			v := m.Count()
@@ -166,12 +245,15 @@ func (config *Config) buildTimeSeries(start string, r metrics.Registry) (pts []*
 				return
 			}
 			p := config.newTimeSeries(name)
+			p.MetricKind = MetricKindCumulative
+			p.ValueType = ValueTypeInt64
 			p.Points = append(p.Points, &cloudmonitoring.Point{
 				Value: &cloudmonitoring.TypedValue{
 					Int64Value: &v,
 				},
 				Interval: &cloudmonitoring.TimeInterval{
-					EndTime: start,
+					StartTime: config.startTimeString(),
+					EndTime:   start,
 				},
 			})
 			pts = append(pts, p)
@@ -207,6 +289,21 @@ func (config *Config) buildTimeSeries(start string, r metrics.Registry) (pts []*
 			pts = append(pts, p)
 		case metrics.Meter:
 			m = m.Snapshot()
+			if v := m.Count(); v != 0 {
+				p := config.newTimeSeries(name + ".count")
+				p.MetricKind = MetricKindCumulative
+				p.ValueType = ValueTypeInt64
+				p.Points = append(p.Points, &cloudmonitoring.Point{
+					Value: &cloudmonitoring.TypedValue{
+						Int64Value: &v,
+					},
+					Interval: &cloudmonitoring.TimeInterval{
+						StartTime: config.startTimeString(),
+						EndTime:   start,
+					},
+				})
+				pts = append(pts, p)
+			}
 			if v := m.RateMean(); v != 0 {
 				p := config.newTimeSeries(name + ".mean")
 				p.Points = append(p.Points, &cloudmonitoring.Point{
@@ -256,16 +353,86 @@ func (config *Config) buildTimeSeries(start string, r metrics.Registry) (pts []*
 				pts = append(pts, p)
 			}
 		case metrics.Histogram:
-			if m.Count() > 0 {
-				histogramsNotImplemented.Do(func() {
-					log.Printf("Histograms are not available in custom metrics, see https://cloud.google.com/monitoring/api/metrics#value-types")
-				})
+			m = m.Snapshot()
+			if m.Count() == 0 {
+				return
 			}
+			dist := config.distribution(m.Count(), m.Mean(), m.Variance()*float64(m.Count()), m.Sample().Values())
+			config.attachExemplar(dist, name, m.Mean())
+			p := config.newTimeSeries(name)
+			p.MetricKind = MetricKindCumulative
+			p.ValueType = ValueTypeDistribution
+			p.Points = append(p.Points, &cloudmonitoring.Point{
+				Value: &cloudmonitoring.TypedValue{
+					DistributionValue: dist,
+				},
+				Interval: &cloudmonitoring.TimeInterval{
+					StartTime: config.startTimeString(),
+					EndTime:   start,
+				},
+			})
+			pts = append(pts, p)
 		case metrics.Timer:
-			if m.Count() > 0 {
-				timersNotImplemented.Do(func() {
-					log.Printf("Timers are not implemented yet")
+			m = m.Snapshot()
+			if m.Count() == 0 {
+				return
+			}
+			values := config.timerSampleValues(name)
+			msValues := make([]int64, len(values))
+			for i, v := range values {
+				msValues[i] = v / int64(time.Millisecond)
+			}
+			meanMs := m.Mean() / float64(time.Millisecond)
+			dist := config.distribution(m.Count(), meanMs, m.Variance()*float64(m.Count())/float64(time.Millisecond*time.Millisecond), msValues)
+			config.attachExemplar(dist, name, meanMs)
+			p := config.newTimeSeries(name)
+			p.MetricKind = MetricKindCumulative
+			p.ValueType = ValueTypeDistribution
+			p.Points = append(p.Points, &cloudmonitoring.Point{
+				Value: &cloudmonitoring.TypedValue{
+					DistributionValue: dist,
+				},
+				Interval: &cloudmonitoring.TimeInterval{
+					StartTime: config.startTimeString(),
+					EndTime:   start,
+				},
+			})
+			pts = append(pts, p)
+			if v := m.Rate1(); v != 0 {
+				p := config.newTimeSeries(name + ".rate1")
+				p.Points = append(p.Points, &cloudmonitoring.Point{
+					Value: &cloudmonitoring.TypedValue{
+						DoubleValue: &v,
+					},
+					Interval: &cloudmonitoring.TimeInterval{
+						EndTime: start,
+					},
 				})
+				pts = append(pts, p)
+			}
+			if v := m.Rate5(); v != 0 {
+				p := config.newTimeSeries(name + ".rate5")
+				p.Points = append(p.Points, &cloudmonitoring.Point{
+					Value: &cloudmonitoring.TypedValue{
+						DoubleValue: &v,
+					},
+					Interval: &cloudmonitoring.TimeInterval{
+						EndTime: start,
+					},
+				})
+				pts = append(pts, p)
+			}
+			if v := m.Rate15(); v != 0 {
+				p := config.newTimeSeries(name + ".rate15")
+				p.Points = append(p.Points, &cloudmonitoring.Point{
+					Value: &cloudmonitoring.TypedValue{
+						DoubleValue: &v,
+					},
+					Interval: &cloudmonitoring.TimeInterval{
+						EndTime: start,
+					},
+				})
+				pts = append(pts, p)
 			}
 		default:
 			log.Printf("unknown metric ? %#v", metric)
@@ -0,0 +1,182 @@
+package gcm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+
+	cloudmonitoring "google.golang.org/api/monitoring/v3"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+//stubMonitoringService starts a fake Cloud Monitoring API server that
+//always accepts CreateTimeSeries requests and hands every request body
+//it receives to capture, then returns a *cloudmonitoring.Service talking
+//to it.
+func stubMonitoringService(t *testing.T, capture func(*cloudmonitoring.CreateTimeSeriesRequest)) *cloudmonitoring.Service {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req cloudmonitoring.CreateTimeSeriesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request body: %s", err)
+		}
+		capture(&req)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(srv.Close)
+	svc, err := cloudmonitoring.NewService(context.Background(),
+		option.WithHTTPClient(srv.Client()),
+		option.WithEndpoint(srv.URL),
+		option.WithoutAuthentication(),
+	)
+	if err != nil {
+		t.Fatalf("stubMonitoringService: %s", err)
+	}
+	return svc
+}
+
+//TestReportCumulativeStartTimeBeforeEndTime guards against a fresh
+//Config's very first Report producing a CUMULATIVE point whose
+//StartTime and EndTime land in the same RFC3339 second, which gcm
+//rejects as an invalid interval.
+func TestReportCumulativeStartTimeBeforeEndTime(t *testing.T) {
+	var sent []*cloudmonitoring.TimeSeries
+	svc := stubMonitoringService(t, func(req *cloudmonitoring.CreateTimeSeriesRequest) {
+		sent = append(sent, req.TimeSeries...)
+	})
+
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("requests", registry).Inc(1)
+
+	config := &Config{Service: svc, Project: "projects/test"}
+	if err := config.Report(registry); err != nil {
+		t.Fatalf("Report: %s", err)
+	}
+
+	if len(sent) == 0 {
+		t.Fatal("no TimeSeries sent")
+	}
+	for _, ts := range sent {
+		for _, p := range ts.Points {
+			if p.Interval.StartTime == "" {
+				continue
+			}
+			if p.Interval.StartTime >= p.Interval.EndTime {
+				t.Fatalf("%s: StartTime %q is not before EndTime %q", ts.Metric.Type, p.Interval.StartTime, p.Interval.EndTime)
+			}
+		}
+	}
+}
+
+//TestBuildTimeSeriesCounter checks the Counter branch of buildTimeSeries:
+//a CUMULATIVE, INT64 point carrying the counter's current total.
+func TestBuildTimeSeriesCounter(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("requests", registry).Inc(42)
+
+	config := &Config{Project: "projects/test", StartTime: time.Now().Add(-time.Minute)}
+	pts, err := config.buildTimeSeries(time.Now().Format(time.RFC3339), registry)
+	if err != nil {
+		t.Fatalf("buildTimeSeries: %s", err)
+	}
+	if len(pts) != 1 {
+		t.Fatalf("got %d TimeSeries, want 1", len(pts))
+	}
+	ts := pts[0]
+	if ts.MetricKind != MetricKindCumulative || ts.ValueType != ValueTypeInt64 {
+		t.Fatalf("MetricKind/ValueType = %s/%s, want %s/%s", ts.MetricKind, ts.ValueType, MetricKindCumulative, ValueTypeInt64)
+	}
+	if got := *ts.Points[0].Value.Int64Value; got != 42 {
+		t.Fatalf("Int64Value = %d, want 42", got)
+	}
+}
+
+//TestBuildTimeSeriesHistogram checks the Histogram branch of
+//buildTimeSeries: a CUMULATIVE Distribution point whose BucketCounts
+//reflect the histogram's recorded samples.
+func TestBuildTimeSeriesHistogram(t *testing.T) {
+	registry := metrics.NewRegistry()
+	h := metrics.GetOrRegisterHistogram("sizes", registry, metrics.NewUniformSample(1028))
+	h.Update(10)
+	h.Update(20)
+
+	config := &Config{Project: "projects/test", StartTime: time.Now().Add(-time.Minute)}
+	pts, err := config.buildTimeSeries(time.Now().Format(time.RFC3339), registry)
+	if err != nil {
+		t.Fatalf("buildTimeSeries: %s", err)
+	}
+	if len(pts) != 1 {
+		t.Fatalf("got %d TimeSeries, want 1", len(pts))
+	}
+	ts := pts[0]
+	if ts.ValueType != ValueTypeDistribution {
+		t.Fatalf("ValueType = %s, want %s", ts.ValueType, ValueTypeDistribution)
+	}
+	dist := ts.Points[0].Value.DistributionValue
+	if dist.Count != 2 {
+		t.Fatalf("Distribution.Count = %d, want 2", dist.Count)
+	}
+}
+
+//TestBuildTimeSeriesTimerWithoutHistogramRegistry checks that a plain
+//Timer (no Config.Histograms set) still reports its full Count, dumped
+//into the Distribution's overflow bucket.
+func TestBuildTimeSeriesTimerWithoutHistogramRegistry(t *testing.T) {
+	registry := metrics.NewRegistry()
+	timer := metrics.GetOrRegisterTimer("latency", registry)
+	timer.Update(5 * time.Millisecond)
+	timer.Update(7 * time.Millisecond)
+
+	config := &Config{Project: "projects/test", StartTime: time.Now().Add(-time.Minute)}
+	pts, err := config.buildTimeSeries(time.Now().Format(time.RFC3339), registry)
+	if err != nil {
+		t.Fatalf("buildTimeSeries: %s", err)
+	}
+	if len(pts) != 1 {
+		t.Fatalf("got %d TimeSeries, want 1 (rates are 0 right after Update)", len(pts))
+	}
+	dist := pts[0].Points[0].Value.DistributionValue
+	if dist.Count != 2 {
+		t.Fatalf("Distribution.Count = %d, want 2", dist.Count)
+	}
+	last := dist.BucketCounts[len(dist.BucketCounts)-1]
+	if last != 2 {
+		t.Fatalf("overflow bucket count = %d, want 2 (no Histogram registered, so the full Count falls back there)", last)
+	}
+}
+
+//TestBuildTimeSeriesTimerWithHistogramRegistry checks that a Timer built
+//through a HistogramRegistry reports real per-bucket counts instead of
+//falling back to the overflow bucket.
+func TestBuildTimeSeriesTimerWithHistogramRegistry(t *testing.T) {
+	registry := metrics.NewRegistry()
+	histograms := NewHistogramRegistry()
+	timer := histograms.NewTimer("latency", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+	registry.Register("latency", timer)
+	timer.Update(5 * time.Millisecond)
+
+	config := &Config{Project: "projects/test", StartTime: time.Now().Add(-time.Minute), Histograms: histograms}
+	pts, err := config.buildTimeSeries(time.Now().Format(time.RFC3339), registry)
+	if err != nil {
+		t.Fatalf("buildTimeSeries: %s", err)
+	}
+	dist := pts[0].Points[0].Value.DistributionValue
+	var total int64
+	for _, c := range dist.BucketCounts {
+		total += c
+	}
+	if total != 1 {
+		t.Fatalf("sum(BucketCounts) = %d, want 1", total)
+	}
+	last := dist.BucketCounts[len(dist.BucketCounts)-1]
+	if last != 0 {
+		t.Fatalf("overflow bucket count = %d, want 0 (a real sample was recovered)", last)
+	}
+}
@@ -0,0 +1,119 @@
+package gcm
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	cloudmonitoring "google.golang.org/api/monitoring/v3"
+)
+
+//metadataClient is the subset of *metadata.Client's methods
+//DetectMonitoredResource needs. It exists so tests can stub the
+//metadata server instead of hitting a real GCE/GKE/Cloud Run instance.
+type metadataClient interface {
+	OnGCEWithContext(ctx context.Context) bool
+	ProjectIDWithContext(ctx context.Context) (string, error)
+	InstanceIDWithContext(ctx context.Context) (string, error)
+	ZoneWithContext(ctx context.Context) (string, error)
+	GetWithContext(ctx context.Context, suffix string) (string, error)
+}
+
+//DetectMonitoredResource inspects the runtime environment and returns
+//the most specific MonitoredResource it can build: cloud_run_revision
+//on Cloud Run (from the K_SERVICE/K_REVISION/K_CONFIGURATION env vars),
+//k8s_container on GKE (from the downward-API env vars, reading
+//KUBERNETES_SERVICE_HOST to detect it's running in a cluster), or
+//gce_instance on any other GCE instance. It falls back to
+//GlobalMonitoredResource when the metadata server isn't reachable,
+//which is the case anywhere outside of GCP.
+func DetectMonitoredResource(ctx context.Context) *cloudmonitoring.MonitoredResource {
+	return detectMonitoredResource(ctx, metadata.NewClient(nil))
+}
+
+//detectMonitoredResource is DetectMonitoredResource with an injectable
+//metadataClient, so it can be driven against a stub server in tests.
+func detectMonitoredResource(ctx context.Context, client metadataClient) *cloudmonitoring.MonitoredResource {
+	if r := detectCloudRun(ctx, client); r != nil {
+		return r
+	}
+	if !client.OnGCEWithContext(ctx) {
+		return GlobalMonitoredResource
+	}
+	if r := detectGKE(ctx, client); r != nil {
+		return r
+	}
+	return detectGCE(ctx, client)
+}
+
+//detectCloudRun builds a cloud_run_revision resource from the env vars
+//the Cloud Run runtime always sets, see
+//https://cloud.google.com/run/docs/container-contract#env-vars
+func detectCloudRun(ctx context.Context, client metadataClient) *cloudmonitoring.MonitoredResource {
+	service := os.Getenv("K_SERVICE")
+	if service == "" {
+		return nil
+	}
+	project, _ := client.ProjectIDWithContext(ctx)
+	region, _ := client.GetWithContext(ctx, "instance/region") // projects/<num>/regions/<region>
+	return &cloudmonitoring.MonitoredResource{
+		Type: "cloud_run_revision",
+		Labels: map[string]string{
+			"project_id":         project,
+			"service_name":       service,
+			"revision_name":      os.Getenv("K_REVISION"),
+			"configuration_name": os.Getenv("K_CONFIGURATION"),
+			"location":           lastPathSegment(region),
+		},
+	}
+}
+
+//detectGKE builds a k8s_container resource from the downward-API env
+//vars a pod spec is expected to set (cluster_name isn't exposed by the
+//downward API, so it's read from CLUSTER_NAME, set manually or injected
+//by the GKE-specific workload defaults).
+func detectGKE(ctx context.Context, client metadataClient) *cloudmonitoring.MonitoredResource {
+	if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return nil
+	}
+	project, _ := client.ProjectIDWithContext(ctx)
+	zone, _ := client.ZoneWithContext(ctx)
+	return &cloudmonitoring.MonitoredResource{
+		Type: "k8s_container",
+		Labels: map[string]string{
+			"project_id":     project,
+			"location":       zone,
+			"cluster_name":   os.Getenv("CLUSTER_NAME"),
+			"namespace_name": os.Getenv("NAMESPACE_NAME"),
+			"pod_name":       os.Getenv("POD_NAME"),
+			"container_name": os.Getenv("CONTAINER_NAME"),
+		},
+	}
+}
+
+//detectGCE builds a gce_instance resource from the GCE metadata server.
+func detectGCE(ctx context.Context, client metadataClient) *cloudmonitoring.MonitoredResource {
+	project, _ := client.ProjectIDWithContext(ctx)
+	instanceID, _ := client.InstanceIDWithContext(ctx)
+	zone, _ := client.ZoneWithContext(ctx)
+	return &cloudmonitoring.MonitoredResource{
+		Type: "gce_instance",
+		Labels: map[string]string{
+			"project_id":  project,
+			"instance_id": instanceID,
+			"zone":        zone,
+		},
+	}
+}
+
+//lastPathSegment returns the part of s after its last '/', used to turn
+//a metadata path like "projects/123/regions/europe-west1" into
+//"europe-west1".
+func lastPathSegment(s string) string {
+	i := strings.LastIndex(s, "/")
+	if i < 0 {
+		return s
+	}
+	return s[i+1:]
+}
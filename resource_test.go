@@ -0,0 +1,144 @@
+package gcm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+//stubMetadataClient starts a fake metadata server serving paths, points
+//the global GCE_METADATA_HOST override at it (the same hook the real
+//cloud.google.com/go/compute/metadata client uses to let callers spoof
+//the metadata service in tests), and returns a *metadata.Client talking
+//to it.
+func stubMetadataClient(t *testing.T, paths map[string]string) *metadata.Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suffix := strings.TrimPrefix(r.URL.Path, "/computeMetadata/v1/")
+		v, ok := paths[suffix]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Metadata-Flavor", "Google")
+		fmt.Fprint(w, v)
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+	return metadata.NewClient(nil)
+}
+
+func TestDetectMonitoredResourceCloudRun(t *testing.T) {
+	t.Setenv("K_SERVICE", "my-service")
+	t.Setenv("K_REVISION", "my-service-00042-abc")
+	t.Setenv("K_CONFIGURATION", "my-service")
+	client := stubMetadataClient(t, map[string]string{
+		"project/project-id": "test-project",
+		"instance/region":    "projects/123456789/regions/europe-west1",
+	})
+
+	r := detectMonitoredResource(context.Background(), client)
+
+	if r.Type != "cloud_run_revision" {
+		t.Fatalf("Type = %q, want cloud_run_revision", r.Type)
+	}
+	want := map[string]string{
+		"project_id":         "test-project",
+		"service_name":       "my-service",
+		"revision_name":      "my-service-00042-abc",
+		"configuration_name": "my-service",
+		"location":           "europe-west1",
+	}
+	for k, v := range want {
+		if r.Labels[k] != v {
+			t.Errorf("Labels[%q] = %q, want %q", k, r.Labels[k], v)
+		}
+	}
+}
+
+func TestDetectMonitoredResourceGKE(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+	t.Setenv("CLUSTER_NAME", "my-cluster")
+	t.Setenv("NAMESPACE_NAME", "default")
+	t.Setenv("POD_NAME", "my-pod-abc")
+	t.Setenv("CONTAINER_NAME", "my-container")
+	client := stubMetadataClient(t, map[string]string{
+		"project/project-id": "test-project",
+		"instance/zone":      "projects/123456789/zones/us-central1-a",
+	})
+
+	r := detectMonitoredResource(context.Background(), client)
+
+	if r.Type != "k8s_container" {
+		t.Fatalf("Type = %q, want k8s_container", r.Type)
+	}
+	want := map[string]string{
+		"project_id":     "test-project",
+		"location":       "us-central1-a",
+		"cluster_name":   "my-cluster",
+		"namespace_name": "default",
+		"pod_name":       "my-pod-abc",
+		"container_name": "my-container",
+	}
+	for k, v := range want {
+		if r.Labels[k] != v {
+			t.Errorf("Labels[%q] = %q, want %q", k, r.Labels[k], v)
+		}
+	}
+}
+
+func TestDetectMonitoredResourceGCE(t *testing.T) {
+	client := stubMetadataClient(t, map[string]string{
+		"project/project-id": "test-project",
+		"instance/id":        "9876543210",
+		"instance/zone":      "projects/123456789/zones/us-central1-a",
+	})
+
+	r := detectMonitoredResource(context.Background(), client)
+
+	if r.Type != "gce_instance" {
+		t.Fatalf("Type = %q, want gce_instance", r.Type)
+	}
+	want := map[string]string{
+		"project_id":  "test-project",
+		"instance_id": "9876543210",
+		"zone":        "us-central1-a",
+	}
+	for k, v := range want {
+		if r.Labels[k] != v {
+			t.Errorf("Labels[%q] = %q, want %q", k, r.Labels[k], v)
+		}
+	}
+}
+
+func TestDetectMonitoredResourceOffGCE(t *testing.T) {
+	t.Setenv("GCE_METADATA_HOST", "")
+
+	r := detectMonitoredResource(context.Background(), offGCEClient{})
+
+	if r != GlobalMonitoredResource {
+		t.Fatalf("got %+v, want GlobalMonitoredResource", r)
+	}
+}
+
+//offGCEClient stubs metadataClient as if run outside of GCP entirely.
+type offGCEClient struct{}
+
+func (offGCEClient) OnGCEWithContext(ctx context.Context) bool { return false }
+func (offGCEClient) ProjectIDWithContext(ctx context.Context) (string, error) {
+	return "", fmt.Errorf("not on GCE")
+}
+func (offGCEClient) InstanceIDWithContext(ctx context.Context) (string, error) {
+	return "", fmt.Errorf("not on GCE")
+}
+func (offGCEClient) ZoneWithContext(ctx context.Context) (string, error) {
+	return "", fmt.Errorf("not on GCE")
+}
+func (offGCEClient) GetWithContext(ctx context.Context, suffix string) (string, error) {
+	return "", fmt.Errorf("not on GCE")
+}